@@ -0,0 +1,269 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package base
+
+import (
+	"container/list"
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// defaultCleanupManagerQueueDepth is the default capacity of the
+// CleanupManager's job queue.
+const defaultCleanupManagerQueueDepth = 1000
+
+// cleanupJob describes a single pending deletion. id is a monotonically
+// increasing identifier, distinct from path, so that two jobs enqueued for
+// the same path (e.g. a file deleted, resurrected, then deleted again) are
+// never confused with one another.
+type cleanupJob struct {
+	id         int64
+	fileType   FileType
+	path       string
+	size       uint64
+	enqueuedAt time.Time
+}
+
+// CleanupManagerOptions configures a CleanupManager.
+type CleanupManagerOptions struct {
+	// QueueDepth bounds how many pending deletions may be enqueued before
+	// Enqueue blocks. Defaults to defaultCleanupManagerQueueDepth.
+	QueueDepth int
+	// OnJobDone, if set, is called after each job finishes, successfully or
+	// not. size is the file's size as observed at Enqueue time, and
+	// queueLatency is how long the job sat in the queue before the worker
+	// goroutine picked it up.
+	OnJobDone func(fileType FileType, path string, size uint64, queueLatency time.Duration, err error)
+	// OnQueueNearlyFull, if set, is called with the current queue length
+	// whenever Enqueue observes the pending queue at or above 90% of
+	// QueueDepth (rounded down).
+	OnQueueNearlyFull func(pending, depth int)
+}
+
+// CleanupManager runs file deletions on a single background goroutine,
+// decoupling callers (typically compaction and flush completion) from the
+// latency of the underlying Cleaner. It replaces ad-hoc "go func() { ...
+// }()" deletion goroutines with a bounded, cancellable, observable queue.
+//
+// A CleanupManager must be created with NewCleanupManager and must have
+// Close called on it once it is no longer needed.
+type CleanupManager struct {
+	fs    vfs.FS
+	inner Cleaner
+	opts  CleanupManagerOptions
+
+	jobs chan *cleanupJob
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+	jobWG  sync.WaitGroup
+
+	nextID atomic.Int64
+
+	mu struct {
+		sync.Mutex
+		// pending, byID and byPath track jobs that have been enqueued but
+		// not yet picked up by the worker goroutine, so Cancel can remove
+		// them before they run. byID is keyed by cleanupJob.id, not path,
+		// since Enqueue may legitimately be called more than once for the
+		// same path before the first call's job is processed.
+		pending *list.List
+		byID    map[int64]*list.Element
+		byPath  map[string][]int64
+	}
+
+	queued         atomic.Int64
+	completed      atomic.Int64
+	failed         atomic.Int64
+	completedBytes atomic.Uint64
+	failedBytes    atomic.Uint64
+}
+
+// NewCleanupManager creates a CleanupManager that deletes files via inner,
+// and starts its background worker goroutine.
+func NewCleanupManager(fs vfs.FS, inner Cleaner, opts CleanupManagerOptions) *CleanupManager {
+	if opts.QueueDepth == 0 {
+		opts.QueueDepth = defaultCleanupManagerQueueDepth
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	m := &CleanupManager{
+		fs:     fs,
+		inner:  inner,
+		opts:   opts,
+		jobs:   make(chan *cleanupJob, opts.QueueDepth),
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	m.mu.pending = list.New()
+	m.mu.byID = make(map[int64]*list.Element)
+	m.mu.byPath = make(map[string][]int64)
+
+	m.wg.Add(1)
+	go m.run()
+	return m
+}
+
+// Enqueue requests that path (of the given fileType) be cleaned up
+// asynchronously. It returns immediately; the deletion happens on the
+// CleanupManager's background goroutine. Enqueue blocks if the queue is
+// full.
+func (m *CleanupManager) Enqueue(fileType FileType, path string) {
+	var size uint64
+	if info, err := m.fs.Stat(path); err == nil {
+		size = uint64(info.Size())
+	}
+
+	job := &cleanupJob{
+		id:         m.nextID.Add(1),
+		fileType:   fileType,
+		path:       path,
+		size:       size,
+		enqueuedAt: time.Now(),
+	}
+
+	m.mu.Lock()
+	if n := m.mu.pending.Len(); m.opts.OnQueueNearlyFull != nil && n >= int(float64(cap(m.jobs))*0.9) {
+		m.opts.OnQueueNearlyFull(n, cap(m.jobs))
+	}
+	elem := m.mu.pending.PushBack(job)
+	m.mu.byID[job.id] = elem
+	m.mu.byPath[path] = append(m.mu.byPath[path], job.id)
+	m.mu.Unlock()
+
+	m.queued.Add(1)
+	m.jobWG.Add(1)
+
+	select {
+	case m.jobs <- job:
+	case <-m.ctx.Done():
+		// The manager is shutting down and run() will never see this job;
+		// undo the bookkeeping we just did and release the waiter, unless
+		// Cancel already removed the job and released it.
+		if m.removePending(job.id, job.path) {
+			m.jobWG.Done()
+		}
+	}
+}
+
+// removePending removes id from the pending/byID/byPath bookkeeping if
+// still present, returning whether it was found.
+func (m *CleanupManager) removePending(id int64, path string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.removePendingLocked(id, path)
+}
+
+func (m *CleanupManager) removePendingLocked(id int64, path string) bool {
+	elem, ok := m.mu.byID[id]
+	if !ok {
+		return false
+	}
+	m.mu.pending.Remove(elem)
+	delete(m.mu.byID, id)
+
+	ids := m.mu.byPath[path]
+	for i, existing := range ids {
+		if existing == id {
+			ids = append(ids[:i], ids[i+1:]...)
+			break
+		}
+	}
+	if len(ids) == 0 {
+		delete(m.mu.byPath, path)
+	} else {
+		m.mu.byPath[path] = ids
+	}
+	return true
+}
+
+// Cancel removes every still-pending job for path, i.e. every job enqueued
+// for path that the worker goroutine has not yet picked up, and reports
+// whether it found and removed at least one. It is useful when a file is
+// resurrected (e.g. re-referenced by a new version) before its scheduled
+// deletion runs.
+func (m *CleanupManager) Cancel(path string) bool {
+	m.mu.Lock()
+	ids := append([]int64(nil), m.mu.byPath[path]...)
+	m.mu.Unlock()
+
+	var removed int
+	for _, id := range ids {
+		if m.removePending(id, path) {
+			removed++
+		}
+	}
+	if removed > 0 {
+		// These jobs will never reach run(), so account for them here.
+		for i := 0; i < removed; i++ {
+			m.jobWG.Done()
+		}
+	}
+	return removed > 0
+}
+
+// Wait blocks until the queue has fully drained, i.e. every job enqueued
+// before the call to Wait has completed (or been cancelled).
+func (m *CleanupManager) Wait() {
+	m.jobWG.Wait()
+}
+
+// Metrics returns the total number of jobs queued, completed, and failed so
+// far, along with the cumulative size of the files successfully deleted
+// (completedBytes) and of those whose deletion failed (failedBytes). It is
+// safe to call concurrently with Enqueue.
+func (m *CleanupManager) Metrics() (queued, completed, failed int64, completedBytes, failedBytes uint64) {
+	return m.queued.Load(), m.completed.Load(), m.failed.Load(),
+		m.completedBytes.Load(), m.failedBytes.Load()
+}
+
+// Close stops the background goroutine, waiting for any in-flight job (but
+// not the remainder of the queue) to finish. The jobs channel is
+// deliberately never closed: closing it here would race with any Enqueue
+// call blocked in its select between sending on m.jobs and observing
+// ctx.Done(), which can panic with "send on closed channel". Shutdown is
+// signaled solely through the context.
+func (m *CleanupManager) Close() {
+	m.cancel()
+	m.wg.Wait()
+}
+
+func (m *CleanupManager) run() {
+	defer m.wg.Done()
+
+	for {
+		select {
+		case job := <-m.jobs:
+			m.runJob(job)
+		case <-m.ctx.Done():
+			return
+		}
+	}
+}
+
+func (m *CleanupManager) runJob(job *cleanupJob) {
+	if !m.removePending(job.id, job.path) {
+		// Cancelled before we got to it; Cancel already accounted for it in
+		// jobWG.
+		return
+	}
+
+	err := m.inner.Clean(m.fs, job.fileType, job.path)
+	if err != nil {
+		m.failed.Add(1)
+		m.failedBytes.Add(job.size)
+	} else {
+		m.completed.Add(1)
+		m.completedBytes.Add(job.size)
+	}
+	if m.opts.OnJobDone != nil {
+		m.opts.OnJobDone(job.fileType, job.path, job.size, time.Since(job.enqueuedAt), err)
+	}
+	m.jobWG.Done()
+}
@@ -0,0 +1,245 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package base
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// writeFile is a small test helper that creates path with n arbitrary
+// bytes, so it has a well-defined size for Enqueue to stat.
+func writeFile(t *testing.T, fs vfs.FS, path string, n int) {
+	t.Helper()
+	f, err := fs.Create(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write(make([]byte, n)); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// TestCleanupManagerDuplicateEnqueue verifies that enqueueing the same path
+// twice before the first job is processed (a file deleted, resurrected,
+// then deleted again) runs both jobs, the first of which deletes the live
+// file, rather than the second Enqueue's bookkeeping being clobbered by the
+// first.
+func TestCleanupManagerDuplicateEnqueue(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "a", 1)
+
+	var mu sync.Mutex
+	var cleaned []string
+	cleaner := cleanerFunc(func(fs vfs.FS, fileType FileType, path string) error {
+		mu.Lock()
+		cleaned = append(cleaned, path)
+		mu.Unlock()
+		return fs.Remove(path)
+	})
+
+	m := NewCleanupManager(fs, cleaner, CleanupManagerOptions{})
+	defer m.Close()
+
+	m.Enqueue(FileTypeTable, "a")
+	m.Enqueue(FileTypeTable, "a")
+	m.Wait()
+
+	mu.Lock()
+	got := len(cleaned)
+	mu.Unlock()
+	if got != 2 {
+		t.Fatalf("expected both enqueued jobs to run, got %d", got)
+	}
+	if _, err := fs.Stat("a"); err == nil {
+		t.Fatalf("expected \"a\" to have been deleted")
+	}
+}
+
+// TestCleanupManagerCloseDuringEnqueue exercises Close racing with a
+// blocked Enqueue: with a full queue, Close must never panic with "send on
+// closed channel".
+func TestCleanupManagerCloseDuringEnqueue(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "a", 1)
+
+	block := make(chan struct{})
+	cleaner := cleanerFunc(func(fs vfs.FS, fileType FileType, path string) error {
+		<-block
+		return nil
+	})
+
+	m := NewCleanupManager(fs, cleaner, CleanupManagerOptions{QueueDepth: 1})
+
+	// "a" occupies the worker goroutine and "b" fills the single queue slot.
+	m.Enqueue(FileTypeTable, "a")
+	m.Enqueue(FileTypeTable, "b")
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		// This Enqueue blocks once the queue and the in-flight job slot are
+		// full; Close should still be able to shut things down cleanly.
+		m.Enqueue(FileTypeTable, "c")
+	}()
+
+	// Close waits for the in-flight job, so release it only after Close has
+	// begun shutting the manager down.
+	time.AfterFunc(10*time.Millisecond, func() { close(block) })
+	m.Close()
+	wg.Wait()
+}
+
+// TestCleanupManagerCancel verifies that Cancel removes a job that the
+// worker goroutine hasn't yet picked up, so its target file is never
+// touched.
+func TestCleanupManagerCancel(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "a", 1)
+	writeFile(t, fs, "b", 1)
+
+	block := make(chan struct{})
+	var mu sync.Mutex
+	var cleaned []string
+	cleaner := cleanerFunc(func(fs vfs.FS, fileType FileType, path string) error {
+		if path == "a" {
+			<-block
+		}
+		mu.Lock()
+		cleaned = append(cleaned, path)
+		mu.Unlock()
+		return fs.Remove(path)
+	})
+
+	m := NewCleanupManager(fs, cleaner, CleanupManagerOptions{QueueDepth: 4})
+	defer m.Close()
+
+	// "a" occupies the single worker goroutine, so "b" is guaranteed to
+	// still be sitting in the pending queue when Cancel runs.
+	m.Enqueue(FileTypeTable, "a")
+	m.Enqueue(FileTypeTable, "b")
+
+	if !m.Cancel("b") {
+		t.Fatalf("expected Cancel to find and remove the pending job for \"b\"")
+	}
+	if m.Cancel("b") {
+		t.Fatalf("expected a second Cancel of an already-cancelled path to report false")
+	}
+
+	close(block)
+	m.Wait()
+
+	mu.Lock()
+	got := append([]string(nil), cleaned...)
+	mu.Unlock()
+	if len(got) != 1 || got[0] != "a" {
+		t.Fatalf("expected only \"a\" to have been cleaned, got %v", got)
+	}
+	if _, err := fs.Stat("b"); err != nil {
+		t.Fatalf("expected \"b\" to survive cancellation, got %v", err)
+	}
+}
+
+// TestCleanupManagerMetrics verifies that Metrics reports queued, completed
+// and failed job counts, along with the cumulative size of the files
+// involved.
+func TestCleanupManagerMetrics(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "ok", 10)
+	writeFile(t, fs, "bad", 20)
+
+	cleaner := cleanerFunc(func(fs vfs.FS, fileType FileType, path string) error {
+		if path == "bad" {
+			return errBoom
+		}
+		return fs.Remove(path)
+	})
+
+	var gotSize uint64
+	var gotLatency time.Duration
+	m := NewCleanupManager(fs, cleaner, CleanupManagerOptions{
+		OnJobDone: func(fileType FileType, path string, size uint64, latency time.Duration, err error) {
+			if path == "ok" {
+				gotSize = size
+				gotLatency = latency
+			}
+		},
+	})
+	defer m.Close()
+
+	m.Enqueue(FileTypeTable, "ok")
+	m.Enqueue(FileTypeTable, "bad")
+	m.Wait()
+
+	queued, completed, failed, completedBytes, failedBytes := m.Metrics()
+	if queued != 2 || completed != 1 || failed != 1 {
+		t.Fatalf("expected queued=2 completed=1 failed=1, got queued=%d completed=%d failed=%d",
+			queued, completed, failed)
+	}
+	if completedBytes != 10 || failedBytes != 20 {
+		t.Fatalf("expected completedBytes=10 failedBytes=20, got %d/%d", completedBytes, failedBytes)
+	}
+	if gotSize != 10 {
+		t.Fatalf("expected OnJobDone to report the enqueued file's size, got %d", gotSize)
+	}
+	if gotLatency < 0 {
+		t.Fatalf("expected a non-negative queue latency, got %s", gotLatency)
+	}
+}
+
+// TestCleanupManagerOnQueueNearlyFull verifies that OnQueueNearlyFull fires
+// once the pending queue is at or above 90% of its configured depth. A
+// QueueDepth of 1 makes the 90% threshold 0, so it must fire on every
+// Enqueue regardless of how quickly the worker goroutine drains the queue,
+// keeping the test deterministic.
+func TestCleanupManagerOnQueueNearlyFull(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "a", 1)
+
+	var mu sync.Mutex
+	var calls int
+	var lastDepth int
+	m := NewCleanupManager(fs, DeleteCleaner{}, CleanupManagerOptions{
+		QueueDepth: 1,
+		OnQueueNearlyFull: func(pending, depth int) {
+			mu.Lock()
+			calls++
+			lastDepth = depth
+			mu.Unlock()
+		},
+	})
+	defer m.Close()
+
+	m.Enqueue(FileTypeTable, "a")
+	m.Wait()
+
+	mu.Lock()
+	gotCalls, gotDepth := calls, lastDepth
+	mu.Unlock()
+	if gotCalls == 0 {
+		t.Fatalf("expected OnQueueNearlyFull to fire for a depth-1 queue")
+	}
+	if gotDepth != 1 {
+		t.Fatalf("expected OnQueueNearlyFull to report depth=1, got %d", gotDepth)
+	}
+}
+
+// errBoom is a sentinel test error.
+var errBoom = errors.New("boom")
+
+// cleanerFunc adapts a function to the Cleaner interface for tests.
+type cleanerFunc func(fs vfs.FS, fileType FileType, path string) error
+
+func (f cleanerFunc) Clean(fs vfs.FS, fileType FileType, path string) error {
+	return f(fs, fileType, path)
+}
@@ -0,0 +1,250 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package base
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// deletionMarkSuffix is appended to a file's path to name its sidecar
+// marker file.
+const deletionMarkSuffix = ".deletion-mark"
+
+// deletionMark is the JSON payload written to a marker file by
+// MarkForDeletionCleaner.Clean.
+type deletionMark struct {
+	Path     string    `json:"path"`
+	FileType FileType  `json:"fileType"`
+	MarkedAt time.Time `json:"markedAt"`
+	Reason   string    `json:"reason"`
+}
+
+// MarkForDeletionCleaner implements a two-phase "mark then delete" tombstone
+// pattern: Clean does not remove the target file itself, it writes a small
+// marker file recording that the target is obsolete. A companion Sweeper,
+// run separately (typically on a timer), finds markers older than a grace
+// period and only then invokes the wrapped Cleaner to actually remove the
+// file. This gives operators a window to recover from an erroneous
+// deletion by simply calling Unmark before the grace period elapses.
+type MarkForDeletionCleaner struct {
+	// Cleaner is invoked by the Sweeper once a marker's grace period has
+	// elapsed, to perform the real deletion (or archival).
+	Cleaner Cleaner
+	// Reason is recorded in each marker file, e.g. "obsolete" or
+	// "compacted".
+	Reason string
+}
+
+// Clean writes a marker file next to path recording that it is obsolete.
+// The file itself is left untouched until a Sweeper later acts on the
+// marker.
+func (c MarkForDeletionCleaner) Clean(fs vfs.FS, fileType FileType, path string) error {
+	mark := deletionMark{
+		Path:     path,
+		FileType: fileType,
+		MarkedAt: time.Now(),
+		Reason:   c.Reason,
+	}
+	data, err := json.Marshal(mark)
+	if err != nil {
+		return err
+	}
+
+	f, err := fs.Create(markerPath(path))
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(data); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+func (MarkForDeletionCleaner) String() string {
+	return "mark-for-deletion"
+}
+
+// Unmark rescues path from a pending deletion by removing its marker file,
+// before the grace period elapses. It is a no-op if path has no pending
+// marker.
+func Unmark(fs vfs.FS, path string) error {
+	if err := fs.Remove(markerPath(path)); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+func markerPath(path string) string {
+	return path + deletionMarkSuffix
+}
+
+// PendingMark describes a marker discovered by LoadMarks.
+type PendingMark struct {
+	Mark deletionMark
+}
+
+// LoadMarks scans the directory tree rooted at root for deletion markers
+// left behind by MarkForDeletionCleaner, so that a Sweeper constructed
+// after a process restart can resume honoring grace periods set before the
+// crash. DB layouts that keep obsolete files in per-level or per-CF
+// subdirectories are scanned recursively.
+//
+// A marker that can't be read or parsed (e.g. truncated by a crash mid
+// write, which this mechanism exists to survive) is skipped rather than
+// aborting the scan; onError, if non-nil, is called with its path and the
+// error so callers can log it.
+func LoadMarks(fs vfs.FS, root string, onError func(path string, err error)) ([]PendingMark, error) {
+	entries, err := fs.List(root)
+	if err != nil {
+		return nil, err
+	}
+
+	var marks []PendingMark
+	for _, name := range entries {
+		full := fs.PathJoin(root, name)
+		info, err := fs.Stat(full)
+		if err != nil {
+			if onError != nil {
+				onError(full, err)
+			}
+			continue
+		}
+		if info.IsDir() {
+			sub, err := LoadMarks(fs, full, onError)
+			if err != nil {
+				if onError != nil {
+					onError(full, err)
+				}
+				continue
+			}
+			marks = append(marks, sub...)
+			continue
+		}
+
+		if !strings.HasSuffix(name, deletionMarkSuffix) {
+			continue
+		}
+		mark, err := readMark(fs, full)
+		if err != nil {
+			if onError != nil {
+				onError(full, err)
+			}
+			continue
+		}
+		marks = append(marks, PendingMark{Mark: mark})
+	}
+	return marks, nil
+}
+
+func readMark(fs vfs.FS, path string) (deletionMark, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return deletionMark{}, err
+	}
+	buf, err := io.ReadAll(f)
+	_ = f.Close()
+	if err != nil {
+		return deletionMark{}, err
+	}
+
+	var mark deletionMark
+	if err := json.Unmarshal(buf, &mark); err != nil {
+		return deletionMark{}, err
+	}
+	return mark, nil
+}
+
+// Sweeper periodically scans a directory tree for deletion markers whose
+// grace period has elapsed, and invokes Cleaner to remove the underlying
+// files.
+type Sweeper struct {
+	FS          vfs.FS
+	Root        string
+	Cleaner     Cleaner
+	GracePeriod time.Duration
+
+	// OnMarkError, if set, is called for every marker LoadMarks has to skip
+	// because it couldn't be read or parsed.
+	OnMarkError func(path string, err error)
+
+	mu      sync.Mutex
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Start begins a background goroutine that scans s.Root every interval,
+// sweeping any marker older than s.GracePeriod.
+func (s *Sweeper) Start(interval time.Duration) {
+	s.mu.Lock()
+	s.closeCh = make(chan struct{})
+	s.mu.Unlock()
+
+	s.wg.Add(1)
+	go func() {
+		defer s.wg.Done()
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				_ = s.SweepOnce()
+			case <-s.closeCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the background scan goroutine started by Start.
+func (s *Sweeper) Stop() {
+	s.mu.Lock()
+	ch := s.closeCh
+	s.mu.Unlock()
+	if ch != nil {
+		close(ch)
+	}
+	s.wg.Wait()
+}
+
+// SweepOnce scans s.Root a single time, deleting any file whose marker is
+// older than s.GracePeriod. A failure to clean up one marker (e.g. its
+// target is already gone) does not stop the sweep from trying the rest;
+// SweepOnce returns the first error encountered, if any, after attempting
+// every mark.
+func (s *Sweeper) SweepOnce() error {
+	marks, err := LoadMarks(s.FS, s.Root, s.OnMarkError)
+	if err != nil {
+		return err
+	}
+
+	now := time.Now()
+	var firstErr error
+	for _, pm := range marks {
+		if now.Sub(pm.Mark.MarkedAt) < s.GracePeriod {
+			continue
+		}
+		if err := s.Cleaner.Clean(s.FS, pm.Mark.FileType, pm.Mark.Path); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+		if err := s.FS.Remove(markerPath(pm.Mark.Path)); err != nil && !os.IsNotExist(err) {
+			if firstErr == nil {
+				firstErr = err
+			}
+			continue
+		}
+	}
+	return firstErr
+}
@@ -0,0 +1,155 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// TestLoadMarksRecursesIntoSubdirectories verifies that markers left in a
+// subdirectory (e.g. a per-level or per-CF layout) are still discovered.
+func TestLoadMarksRecursesIntoSubdirectories(t *testing.T) {
+	fs := vfs.NewMem()
+	if err := fs.MkdirAll("level0/cf1", 0755); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, fs, "level0/cf1/000001.sst", 1)
+
+	c := MarkForDeletionCleaner{Cleaner: DeleteCleaner{}, Reason: "obsolete"}
+	if err := c.Clean(fs, FileTypeTable, "level0/cf1/000001.sst"); err != nil {
+		t.Fatal(err)
+	}
+
+	marks, err := LoadMarks(fs, "level0", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 1 || marks[0].Mark.Path != "level0/cf1/000001.sst" {
+		t.Fatalf("expected to find the mark in the nested directory, got %+v", marks)
+	}
+}
+
+// TestLoadMarksSkipsCorruptMarker verifies that a truncated/corrupt marker
+// (the expected failure mode after a crash mid-write) is skipped, via the
+// onError callback, rather than aborting the scan and losing every other
+// valid mark.
+func TestLoadMarksSkipsCorruptMarker(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "good", 1)
+	writeFile(t, fs, "bad", 1)
+
+	c := MarkForDeletionCleaner{Cleaner: DeleteCleaner{}, Reason: "obsolete"}
+	if err := c.Clean(fs, FileTypeTable, "good"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a marker truncated mid-write: not valid JSON.
+	f, err := fs.Create(markerPath("bad"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("{not valid json")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	var skipped []string
+	marks, err := LoadMarks(fs, "", func(path string, err error) {
+		skipped = append(skipped, path)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(marks) != 1 || marks[0].Mark.Path != "good" {
+		t.Fatalf("expected only the valid mark to survive, got %+v", marks)
+	}
+	if len(skipped) != 1 || skipped[0] != markerPath("bad") {
+		t.Fatalf("expected onError to report the corrupt marker, got %v", skipped)
+	}
+}
+
+// TestUnmarkRescuesFile verifies that Unmark removes a pending marker so
+// that a subsequent sweep, even past its grace period, leaves the file
+// alone.
+func TestUnmarkRescuesFile(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "a", 1)
+
+	c := MarkForDeletionCleaner{Cleaner: DeleteCleaner{}, Reason: "obsolete"}
+	if err := c.Clean(fs, FileTypeTable, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	marks, err := LoadMarks(fs, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 1 {
+		t.Fatalf("expected one pending mark before Unmark, got %d", len(marks))
+	}
+
+	if err := Unmark(fs, "a"); err != nil {
+		t.Fatal(err)
+	}
+
+	marks, err = LoadMarks(fs, "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(marks) != 0 {
+		t.Fatalf("expected no pending marks after Unmark, got %d", len(marks))
+	}
+
+	s := &Sweeper{FS: fs, Root: "", Cleaner: DeleteCleaner{}, GracePeriod: -time.Second}
+	if err := s.SweepOnce(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := fs.Stat("a"); err != nil {
+		t.Fatalf("expected \"a\" to survive a sweep after being rescued by Unmark, got %v", err)
+	}
+}
+
+// TestUnmarkOnUnmarkedPathIsNoOp verifies that Unmark doesn't error when
+// called for a path that was never marked.
+func TestUnmarkOnUnmarkedPathIsNoOp(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "a", 1)
+
+	if err := Unmark(fs, "a"); err != nil {
+		t.Fatalf("expected Unmark of an unmarked path to be a no-op, got %v", err)
+	}
+}
+
+// TestSweeperContinuesPastError verifies that a failure to clean one
+// marker's target doesn't prevent the sweep from processing the rest.
+func TestSweeperContinuesPastError(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "good", 1)
+
+	c := MarkForDeletionCleaner{Cleaner: DeleteCleaner{}, Reason: "obsolete"}
+	// "missing" never actually exists on disk, so cleaning it will fail,
+	// but its marker is still written directly here to simulate that.
+	if err := c.Clean(fs, FileTypeTable, "missing"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Clean(fs, FileTypeTable, "good"); err != nil {
+		t.Fatal(err)
+	}
+
+	s := &Sweeper{FS: fs, Root: "", Cleaner: DeleteCleaner{}, GracePeriod: -time.Second}
+	if err := s.SweepOnce(); err == nil {
+		t.Fatalf("expected SweepOnce to report the error from the missing file")
+	}
+
+	if _, err := fs.Stat("good"); err == nil {
+		t.Fatalf("expected \"good\" to have been swept despite \"missing\" failing")
+	}
+}
@@ -0,0 +1,233 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package base
+
+import (
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// defaultPacedCleanerMaxSleep bounds how long a single Clean call will block
+// waiting for tokens, so a misconfigured rate can't wedge the deleting
+// goroutine indefinitely.
+const defaultPacedCleanerMaxSleep = 1 * time.Second
+
+// pacedCleanerTokenBucket is a simple token bucket, sized in bytes, used to
+// pace deletions. It mirrors the refill-on-demand token bucket used by
+// Pebble's compaction and flush paths: tokens accumulate at a fixed rate up
+// to a burst ceiling, and Wait blocks (up to a caller-supplied cap) until
+// enough tokens are available.
+type pacedCleanerTokenBucket struct {
+	mu sync.Mutex
+
+	burst      float64
+	fillRate   float64 // tokens (bytes) per second
+	available  float64
+	lastRefill time.Time
+}
+
+func (b *pacedCleanerTokenBucket) init(bytesPerSec, burst int64) {
+	b.fillRate = float64(bytesPerSec)
+	b.burst = float64(burst)
+	b.available = float64(burst)
+	b.lastRefill = time.Now()
+}
+
+func (b *pacedCleanerTokenBucket) refillLocked(now time.Time) {
+	if elapsed := now.Sub(b.lastRefill); elapsed > 0 {
+		b.available += elapsed.Seconds() * b.fillRate
+		if b.available > b.burst {
+			b.available = b.burst
+		}
+		b.lastRefill = now
+	}
+}
+
+// wait blocks until n tokens are available, or until maxSleep has elapsed,
+// whichever comes first. It returns the amount of time spent waiting.
+func (b *pacedCleanerTokenBucket) wait(n float64, maxSleep time.Duration) time.Duration {
+	b.mu.Lock()
+	now := time.Now()
+	b.refillLocked(now)
+	if b.available >= n {
+		b.available -= n
+		b.mu.Unlock()
+		return 0
+	}
+	deficit := n - b.available
+	sleep := time.Duration(deficit / b.fillRate * float64(time.Second))
+	if sleep > maxSleep {
+		sleep = maxSleep
+	}
+	b.available = 0
+	b.mu.Unlock()
+
+	if sleep > 0 {
+		time.Sleep(sleep)
+	}
+
+	b.mu.Lock()
+	b.refillLocked(time.Now())
+	if b.available >= n {
+		b.available -= n
+	} else {
+		b.available = 0
+	}
+	b.mu.Unlock()
+	return sleep
+}
+
+// PacedCleaner wraps another Cleaner and rate-limits the pace at which it is
+// invoked, measured in bytes/second of deleted file size. It is meant to
+// prevent a burst of obsolete SST deletions (e.g. after a large compaction
+// or a DB Close) from starving foreground I/O on the same disk, mirroring
+// the deletion pacer used by Pebble's cleanupManager upstream.
+//
+// Pacing is automatically bypassed --- deletes proceed at full speed --- once
+// free disk space drops below FreeSpaceThreshold, or once the backlog of
+// known-obsolete bytes exceeds ObsoleteBytesThreshold. Both are safety
+// valves: it is better to fall behind on pacing than to let disk exhaustion
+// or Cleaner backlog bring the store down.
+type PacedCleaner struct {
+	// Cleaner is the wrapped Cleaner that actually performs the deletion (or
+	// archival) once pacing has admitted the request.
+	Cleaner Cleaner
+
+	// BytesPerSec is the target steady-state deletion rate.
+	BytesPerSec int64
+	// Burst is the maximum number of bytes that can be deleted without
+	// waiting, i.e. the token bucket's capacity.
+	Burst int64
+	// MaxSleep bounds how long a single Clean call will block waiting for
+	// tokens. Defaults to defaultPacedCleanerMaxSleep.
+	MaxSleep time.Duration
+
+	// FreeSpaceThreshold disables pacing while the filesystem reports fewer
+	// free bytes than this. Zero disables the check.
+	FreeSpaceThreshold uint64
+	// ObsoleteBytesThreshold disables pacing once the obsolete backlog (as
+	// reported by the caller via AddObsoleteBytes) exceeds this many bytes. Zero
+	// disables the check.
+	ObsoleteBytesThreshold uint64
+
+	// onPace, if set, is called during every Clean call that goes through
+	// pacing (whether or not it had to wait), after the wait for tokens and
+	// before the wrapped Cleaner runs.
+	onPace func(size uint64, waited time.Duration)
+	// onDelete, if set, is called after every successful Clean call,
+	// regardless of whether pacing was bypassed.
+	onDelete func(fileType FileType, size uint64)
+
+	mu struct {
+		sync.Mutex
+		obsoleteBytes uint64
+	}
+	bucket pacedCleanerTokenBucket
+	once   sync.Once
+}
+
+// NewPacedCleaner creates a PacedCleaner that paces deletions performed by
+// inner at the given rate.
+func NewPacedCleaner(inner Cleaner, bytesPerSec, burst int64) *PacedCleaner {
+	p := &PacedCleaner{
+		Cleaner:     inner,
+		BytesPerSec: bytesPerSec,
+		Burst:       burst,
+	}
+	p.ensureInit()
+	return p
+}
+
+func (p *PacedCleaner) ensureInit() {
+	p.once.Do(func() {
+		if p.MaxSleep == 0 {
+			p.MaxSleep = defaultPacedCleanerMaxSleep
+		}
+		p.bucket.init(p.BytesPerSec, p.Burst)
+	})
+}
+
+// OnPace registers a callback invoked whenever a Clean call is paced,
+// reporting the file size and how long the call slept waiting for tokens.
+func (p *PacedCleaner) OnPace(fn func(size uint64, waited time.Duration)) {
+	p.onPace = fn
+}
+
+// OnDelete registers a callback invoked after every successful Clean call.
+func (p *PacedCleaner) OnDelete(fn func(fileType FileType, size uint64)) {
+	p.onDelete = fn
+}
+
+// AddObsoleteBytes informs the PacedCleaner of additional bytes that are now
+// known to be obsolete but not yet cleaned, so it can decide whether to
+// bypass pacing once ObsoleteBytesThreshold is crossed. Callers typically
+// invoke this as they discover obsolete files, ahead of calling Clean on
+// each one.
+func (p *PacedCleaner) AddObsoleteBytes(n uint64) {
+	p.mu.Lock()
+	p.mu.obsoleteBytes += n
+	p.mu.Unlock()
+}
+
+func (p *PacedCleaner) bypassPacing(fs vfs.FS, path string) bool {
+	if p.ObsoleteBytesThreshold > 0 {
+		p.mu.Lock()
+		obsolete := p.mu.obsoleteBytes
+		p.mu.Unlock()
+		if obsolete > p.ObsoleteBytesThreshold {
+			return true
+		}
+	}
+	if p.FreeSpaceThreshold > 0 {
+		if free, err := fs.GetDiskUsage(fs.PathDir(path)); err == nil {
+			if free.AvailBytes < p.FreeSpaceThreshold {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Clean implements the Cleaner interface. It stats path to learn its size,
+// waits for enough tokens to admit a deletion of that size (unless pacing is
+// bypassed), and then delegates to the wrapped Cleaner.
+func (p *PacedCleaner) Clean(fs vfs.FS, fileType FileType, path string) error {
+	p.ensureInit()
+
+	var size uint64
+	if info, err := fs.Stat(path); err == nil {
+		size = uint64(info.Size())
+	}
+
+	if !p.bypassPacing(fs, path) {
+		waited := p.bucket.wait(float64(size), p.MaxSleep)
+		if p.onPace != nil {
+			p.onPace(size, waited)
+		}
+	}
+
+	err := p.Cleaner.Clean(fs, fileType, path)
+	if err == nil {
+		if p.ObsoleteBytesThreshold > 0 {
+			p.mu.Lock()
+			if p.mu.obsoleteBytes >= size {
+				p.mu.obsoleteBytes -= size
+			} else {
+				p.mu.obsoleteBytes = 0
+			}
+			p.mu.Unlock()
+		}
+		if p.onDelete != nil {
+			p.onDelete(fileType, size)
+		}
+	}
+	return err
+}
+
+func (p *PacedCleaner) String() string {
+	return "paced"
+}
@@ -0,0 +1,145 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// dirDiskUsageFS wraps a vfs.FS and reports a caller-supplied disk usage
+// per directory, so tests can assert that callers check the free space of
+// the directory that actually holds the file in question.
+type dirDiskUsageFS struct {
+	vfs.FS
+	usage map[string]vfs.DiskUsage
+}
+
+func (fs *dirDiskUsageFS) GetDiskUsage(dir string) (vfs.DiskUsage, error) {
+	return fs.usage[dir], nil
+}
+
+// TestPacedCleanerFreeSpaceThresholdPerDirectory verifies that
+// FreeSpaceThreshold is evaluated against the free space of the directory
+// holding the file being deleted, not some unrelated path.
+func TestPacedCleanerFreeSpaceThresholdPerDirectory(t *testing.T) {
+	mem := vfs.NewMem()
+	writeFile(t, mem, "full/a", 1)
+	writeFile(t, mem, "spare/b", 1)
+
+	fs := &dirDiskUsageFS{
+		FS: mem,
+		usage: map[string]vfs.DiskUsage{
+			"full":  {AvailBytes: 1},
+			"spare": {AvailBytes: 1 << 30},
+		},
+	}
+
+	var paced bool
+	p := NewPacedCleaner(DeleteCleaner{}, 1, 1)
+	p.FreeSpaceThreshold = 1 << 20
+	p.OnPace(func(size uint64, waited time.Duration) { paced = true })
+
+	if err := p.Clean(fs, FileTypeTable, "full/a"); err != nil {
+		t.Fatal(err)
+	}
+	if paced {
+		t.Fatalf("expected pacing to be bypassed when the file's own directory is low on space")
+	}
+
+	paced = false
+	if err := p.Clean(fs, FileTypeTable, "spare/b"); err != nil {
+		t.Fatal(err)
+	}
+	if !paced {
+		t.Fatalf("expected pacing to apply when the file's own directory has ample space")
+	}
+}
+
+// TestPacedCleanerMaxSleepCaps verifies that a Clean call whose file is far
+// larger than the available tokens doesn't block indefinitely: it sleeps
+// for at most MaxSleep before delegating to the wrapped Cleaner anyway.
+func TestPacedCleanerMaxSleepCaps(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "a", 1000)
+
+	p := NewPacedCleaner(DeleteCleaner{}, 1 /* bytesPerSec */, 1 /* burst */)
+	p.MaxSleep = 20 * time.Millisecond
+
+	var waited time.Duration
+	p.OnPace(func(size uint64, w time.Duration) { waited = w })
+
+	start := time.Now()
+	if err := p.Clean(fs, FileTypeTable, "a"); err != nil {
+		t.Fatal(err)
+	}
+	elapsed := time.Since(start)
+
+	if waited != p.MaxSleep {
+		t.Fatalf("expected the pacer to report a %s wait capped by MaxSleep, got %s", p.MaxSleep, waited)
+	}
+	if elapsed < p.MaxSleep || elapsed > p.MaxSleep+100*time.Millisecond {
+		t.Fatalf("expected Clean to take roughly MaxSleep (%s), took %s", p.MaxSleep, elapsed)
+	}
+	if _, err := fs.Stat("a"); err == nil {
+		t.Fatalf("expected the file to still be deleted after the capped wait")
+	}
+}
+
+// TestPacedCleanerObsoleteBytesBypass verifies that pacing is bypassed once
+// the caller-reported obsolete backlog exceeds ObsoleteBytesThreshold, even
+// though the configured rate would otherwise force a long wait.
+func TestPacedCleanerObsoleteBytesBypass(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "a", 1000)
+
+	p := NewPacedCleaner(DeleteCleaner{}, 1 /* bytesPerSec */, 1 /* burst */)
+	p.MaxSleep = time.Minute
+	p.ObsoleteBytesThreshold = 100
+	p.AddObsoleteBytes(200)
+
+	var paced bool
+	p.OnPace(func(size uint64, waited time.Duration) { paced = true })
+
+	done := make(chan error, 1)
+	go func() { done <- p.Clean(fs, FileTypeTable, "a") }()
+
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected Clean to bypass pacing and return promptly")
+	}
+	if paced {
+		t.Fatalf("expected pacing to be bypassed once the obsolete backlog exceeds the threshold")
+	}
+}
+
+// TestPacedCleanerOnDelete verifies that OnDelete is called with the
+// deleted file's type and size after a successful Clean.
+func TestPacedCleanerOnDelete(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "a", 42)
+
+	p := NewPacedCleaner(DeleteCleaner{}, 1<<20 /* bytesPerSec */, 1<<20 /* burst */)
+
+	var gotType FileType
+	var gotSize uint64
+	p.OnDelete(func(fileType FileType, size uint64) {
+		gotType = fileType
+		gotSize = size
+	})
+
+	if err := p.Clean(fs, FileTypeTable, "a"); err != nil {
+		t.Fatal(err)
+	}
+	if gotType != FileTypeTable || gotSize != 42 {
+		t.Fatalf("expected OnDelete(FileTypeTable, 42), got (%v, %d)", gotType, gotSize)
+	}
+}
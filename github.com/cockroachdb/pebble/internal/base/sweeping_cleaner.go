@@ -0,0 +1,153 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package base
+
+import (
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// SweepingCleaner wraps another Cleaner and, in addition to cleaning the
+// file it is asked about, opportunistically removes stale sidecar files
+// left behind in the same directory by interrupted operations -- e.g.
+// "*.tmp", "MANIFEST-*.new", or a partial SST rewrite. These accumulate
+// after crashes and are otherwise only cleaned up by an operator noticing
+// disk usage creep.
+type SweepingCleaner struct {
+	// Cleaner is the wrapped Cleaner that performs the requested deletion.
+	Cleaner Cleaner
+
+	// StalePatterns is a set of filepath.Match-style patterns (matched
+	// against the base name) identifying stale sidecar files, e.g.
+	// []string{"*.tmp", "MANIFEST-*.new"}.
+	StalePatterns []string
+	// IsStale, if set, is an additional predicate consulted for entries
+	// that don't match StalePatterns.
+	IsStale func(vfs.FileInfo) bool
+	// MinAge is the minimum age (by mtime) a matching entry must have
+	// before it is swept. This avoids racing a sweep against a file that a
+	// concurrent operation is still writing.
+	MinAge time.Duration
+	// SweepInterval, if non-zero, additionally sweeps on a timer via
+	// Start/Stop rather than only piggybacking on Clean calls.
+	SweepInterval time.Duration
+
+	// OnSweep, if set, is called after each sweep that removed at least one
+	// file, with the number and total size of the files removed.
+	OnSweep func(count int, totalSize uint64)
+
+	mu      sync.Mutex
+	closeCh chan struct{}
+	wg      sync.WaitGroup
+}
+
+// Clean delegates to the wrapped Cleaner, then opportunistically sweeps the
+// parent directory of path for stale sidecar files.
+func (c *SweepingCleaner) Clean(fs vfs.FS, fileType FileType, path string) error {
+	err := c.Cleaner.Clean(fs, fileType, path)
+	c.sweep(fs, fs.PathDir(path))
+	return err
+}
+
+func (*SweepingCleaner) String() string {
+	return "sweeping"
+}
+
+// Start begins a background goroutine that sweeps root every
+// c.SweepInterval, in addition to the sweeps triggered by Clean. It is a
+// no-op if c.SweepInterval is zero.
+func (c *SweepingCleaner) Start(fs vfs.FS, root string) {
+	if c.SweepInterval == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	c.closeCh = make(chan struct{})
+	c.mu.Unlock()
+
+	c.wg.Add(1)
+	go func() {
+		defer c.wg.Done()
+		ticker := time.NewTicker(c.SweepInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				c.sweep(fs, root)
+			case <-c.closeCh:
+				return
+			}
+		}
+	}()
+}
+
+// Stop halts the background timer goroutine started by Start.
+func (c *SweepingCleaner) Stop() {
+	c.mu.Lock()
+	ch := c.closeCh
+	c.mu.Unlock()
+	if ch != nil {
+		close(ch)
+	}
+	c.wg.Wait()
+}
+
+func (c *SweepingCleaner) sweep(fs vfs.FS, dir string) {
+	entries, err := fs.List(dir)
+	if err != nil {
+		return
+	}
+
+	var count int
+	var totalSize uint64
+	now := time.Now()
+	for _, name := range entries {
+		if !c.matches(name) {
+			continue
+		}
+
+		full := fs.PathJoin(dir, name)
+		info, err := fs.Stat(full)
+		if err != nil {
+			continue
+		}
+		if now.Sub(info.ModTime()) < c.MinAge {
+			continue
+		}
+		if c.IsStale != nil && !c.matchesPattern(name) && !c.IsStale(info) {
+			continue
+		}
+
+		size := uint64(info.Size())
+		if err := fs.Remove(full); err != nil {
+			continue
+		}
+		count++
+		totalSize += size
+	}
+
+	if count > 0 && c.OnSweep != nil {
+		c.OnSweep(count, totalSize)
+	}
+}
+
+func (c *SweepingCleaner) matches(name string) bool {
+	if c.matchesPattern(name) {
+		return true
+	}
+	return c.IsStale != nil
+}
+
+func (c *SweepingCleaner) matchesPattern(name string) bool {
+	for _, pattern := range c.StalePatterns {
+		if ok, err := filepath.Match(pattern, name); err == nil && ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,74 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package base
+
+import (
+	"testing"
+	"time"
+
+	"github.com/cockroachdb/pebble/vfs"
+)
+
+// TestSweepingCleanerSweepsStalePatterns verifies that Clean removes stale
+// sidecar files matching StalePatterns, while leaving files that don't match
+// the pattern alone. MinAge is covered by TestSweepingCleanerRespectsMinAge.
+func TestSweepingCleanerSweepsStalePatterns(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "000001.sst", 1)
+	writeFile(t, fs, "000002.sst.tmp", 1)
+	writeFile(t, fs, "MANIFEST-000003.new", 1)
+	writeFile(t, fs, "CURRENT", 1)
+
+	var sweptCount int
+	var sweptSize uint64
+	c := &SweepingCleaner{
+		Cleaner:       DeleteCleaner{},
+		StalePatterns: []string{"*.tmp", "MANIFEST-*.new"},
+		MinAge:        0,
+		OnSweep: func(count int, totalSize uint64) {
+			sweptCount += count
+			sweptSize += totalSize
+		},
+	}
+
+	if err := c.Clean(fs, FileTypeTable, "000001.sst"); err != nil {
+		t.Fatal(err)
+	}
+
+	if sweptCount != 2 {
+		t.Fatalf("expected 2 stale files swept, got %d (size %d)", sweptCount, sweptSize)
+	}
+	if _, err := fs.Stat("000002.sst.tmp"); err == nil {
+		t.Fatalf("expected *.tmp file to be swept")
+	}
+	if _, err := fs.Stat("MANIFEST-000003.new"); err == nil {
+		t.Fatalf("expected MANIFEST-*.new file to be swept")
+	}
+	if _, err := fs.Stat("CURRENT"); err != nil {
+		t.Fatalf("expected CURRENT to be left alone, got %v", err)
+	}
+}
+
+// TestSweepingCleanerRespectsMinAge verifies that a stale-pattern match
+// younger than MinAge is left alone.
+func TestSweepingCleanerRespectsMinAge(t *testing.T) {
+	fs := vfs.NewMem()
+	writeFile(t, fs, "000001.sst", 1)
+	writeFile(t, fs, "000002.sst.tmp", 1)
+
+	c := &SweepingCleaner{
+		Cleaner:       DeleteCleaner{},
+		StalePatterns: []string{"*.tmp"},
+		MinAge:        time.Hour,
+	}
+
+	if err := c.Clean(fs, FileTypeTable, "000001.sst"); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := fs.Stat("000002.sst.tmp"); err != nil {
+		t.Fatalf("expected recently-written *.tmp file to survive MinAge check, got %v", err)
+	}
+}